@@ -0,0 +1,44 @@
+// Copyright 2013, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package key defines the types used to represent keyspace ids and key
+// ranges in keyspaces that are sharded by a hash or range of a key.
+package key
+
+// KeyspaceId is the type used to represent a single key in a sharded
+// keyspace. It is a byte string, typically the result of hashing or
+// encoding a sharding key, and can be compared lexicographically.
+type KeyspaceId string
+
+// KeyRange describes a range of keyspace ids, half-open like Go slices:
+// it contains ids such that Start <= id < End. An empty Start means the
+// range is unbounded below, and an empty End means it is unbounded
+// above. A KeyRange with both bounds empty covers the entire keyspace.
+type KeyRange struct {
+	Start KeyspaceId
+	End   KeyspaceId
+}
+
+// Contains returns true if id belongs to the range.
+func (kr KeyRange) Contains(id KeyspaceId) bool {
+	return (kr.Start == "" || kr.Start <= id) && (kr.End == "" || id < kr.End)
+}
+
+// Overlaps returns true if kr and other share at least one keyspace id.
+func (kr KeyRange) Overlaps(other KeyRange) bool {
+	if kr.Start != "" && other.End != "" && kr.Start >= other.End {
+		return false
+	}
+	if other.Start != "" && kr.End != "" && other.Start >= kr.End {
+		return false
+	}
+	return true
+}
+
+// KeyspaceIdArray is a sortable array of KeyspaceId.
+type KeyspaceIdArray []KeyspaceId
+
+func (k KeyspaceIdArray) Len() int           { return len(k) }
+func (k KeyspaceIdArray) Less(i, j int) bool { return k[i] < k[j] }
+func (k KeyspaceIdArray) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
@@ -0,0 +1,80 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryMetadataStore is an in-process MetadataStore: transaction
+// records live only in memory and are lost if the process restarts,
+// which defeats the point of recording them durably before
+// CommitPrepared. It exists for tests and single-process development
+// setups; a real deployment should back MetadataStore with a
+// replicated metadata shard instead.
+type MemoryMetadataStore struct {
+	mu   sync.Mutex
+	txns map[string]*DistributedTransaction
+}
+
+// NewMemoryMetadataStore returns an empty MemoryMetadataStore.
+func NewMemoryMetadataStore() *MemoryMetadataStore {
+	return &MemoryMetadataStore{txns: make(map[string]*DistributedTransaction)}
+}
+
+func (s *MemoryMetadataStore) CreateTransaction(dtid string, participants []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.txns[dtid]; ok {
+		return fmt.Errorf("transaction %s already exists", dtid)
+	}
+	s.txns[dtid] = &DistributedTransaction{
+		Dtid:         dtid,
+		Participants: append([]string(nil), participants...),
+		State:        TxPreparing,
+	}
+	return nil
+}
+
+func (s *MemoryMetadataStore) UpdateState(dtid string, state TransactionState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	txn, ok := s.txns[dtid]
+	if !ok {
+		return fmt.Errorf("transaction %s not found", dtid)
+	}
+	txn.State = state
+	return nil
+}
+
+func (s *MemoryMetadataStore) ReadTransaction(dtid string) (*DistributedTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	txn, ok := s.txns[dtid]
+	if !ok {
+		return nil, fmt.Errorf("transaction %s not found", dtid)
+	}
+	copied := *txn
+	copied.Participants = append([]string(nil), txn.Participants...)
+	return &copied, nil
+}
+
+func (s *MemoryMetadataStore) ListPending() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dtids := make([]string, 0, len(s.txns))
+	for dtid := range s.txns {
+		dtids = append(dtids, dtid)
+	}
+	return dtids, nil
+}
+
+func (s *MemoryMetadataStore) DeleteTransaction(dtid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.txns, dtid)
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import "testing"
+
+func TestMemoryMetadataStoreLifecycle(t *testing.T) {
+	store := NewMemoryMetadataStore()
+
+	if err := store.CreateTransaction("dtid1", []string{"a/0", "a/1"}); err != nil {
+		t.Fatalf("CreateTransaction: %v", err)
+	}
+	if err := store.CreateTransaction("dtid1", []string{"a/0"}); err == nil {
+		t.Fatalf("CreateTransaction on an existing dtid succeeded, want an error")
+	}
+
+	txn, err := store.ReadTransaction("dtid1")
+	if err != nil {
+		t.Fatalf("ReadTransaction: %v", err)
+	}
+	if txn.State != TxPreparing {
+		t.Fatalf("State = %v, want TxPreparing", txn.State)
+	}
+
+	if err := store.UpdateState("dtid1", TxCommitting); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	txn, err = store.ReadTransaction("dtid1")
+	if err != nil {
+		t.Fatalf("ReadTransaction after UpdateState: %v", err)
+	}
+	if txn.State != TxCommitting {
+		t.Fatalf("State = %v, want TxCommitting", txn.State)
+	}
+
+	pending, err := store.ListPending()
+	if err != nil {
+		t.Fatalf("ListPending: %v", err)
+	}
+	if len(pending) != 1 || pending[0] != "dtid1" {
+		t.Fatalf("ListPending = %v, want [dtid1]", pending)
+	}
+
+	if err := store.DeleteTransaction("dtid1"); err != nil {
+		t.Fatalf("DeleteTransaction: %v", err)
+	}
+	if _, err := store.ReadTransaction("dtid1"); err == nil {
+		t.Fatalf("ReadTransaction after delete succeeded, want an error")
+	}
+}
+
+func TestMemoryMetadataStoreUpdateStateMissing(t *testing.T) {
+	store := NewMemoryMetadataStore()
+	if err := store.UpdateState("nonexistent", TxCommitting); err == nil {
+		t.Fatalf("UpdateState on a missing dtid succeeded, want an error")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+// TransactionState is the lifecycle state of a distributed transaction
+// tracked by the MetadataStore.
+type TransactionState int
+
+const (
+	// TxPreparing means the transaction record has been durably written
+	// but Prepare may not yet have reached every participant.
+	TxPreparing TransactionState = iota
+	// TxCommitting means the transaction record is durable and
+	// CommitPrepared is being (or still needs to be) sent to every
+	// participant.
+	TxCommitting
+)
+
+// DistributedTransaction is the durable record of an in-flight atomic
+// commit: the dtid that identifies it, the shards that must agree to
+// commit it, and how far along it got.
+type DistributedTransaction struct {
+	Dtid         string
+	Participants []string
+	State        TransactionState
+}
+
+// MetadataStore persists distributed transaction records to a metadata
+// shard so that a crash between Prepare and CommitPrepared can be
+// recovered from: without this, a VTGate crash mid-commit would leave
+// some participants prepared and others not, with nothing left to drive
+// them to a consistent outcome.
+type MetadataStore interface {
+	// CreateTransaction durably records dtid and its participants before
+	// any CommitPrepared is sent.
+	CreateTransaction(dtid string, participants []string) error
+	// UpdateState advances the recorded state of dtid.
+	UpdateState(dtid string, state TransactionState) error
+	// ReadTransaction returns the record for dtid, or an error if it has
+	// no pending record (e.g. it was already resolved and deleted).
+	ReadTransaction(dtid string) (*DistributedTransaction, error)
+	// ListPending returns the dtids that have a durable record but have
+	// not yet been deleted, i.e. transactions recovery still needs to
+	// examine.
+	ListPending() ([]string, error)
+	// DeleteTransaction removes the record for dtid once it has been
+	// driven to a terminal outcome on every participant.
+	DeleteTransaction(dtid string) error
+}
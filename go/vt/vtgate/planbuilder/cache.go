@@ -0,0 +1,38 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import "sync"
+
+// Cache caches Routes by a caller-chosen key, typically normalized SQL
+// text (or normalized SQL combined with whatever else a Route depends
+// on, such as the keyspace it was built against), so that a statement
+// only has to be parsed once no matter how many times it (or an
+// identical statement with different literal values) is executed. It is
+// safe for concurrent use.
+type Cache struct {
+	mu     sync.Mutex
+	routes map[string]*Route
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{routes: make(map[string]*Route)}
+}
+
+// Get returns the cached Route for key, if any.
+func (c *Cache) Get(key string) (*Route, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	route, ok := c.routes[key]
+	return route, ok
+}
+
+// Set caches route under key.
+func (c *Cache) Set(key string, route *Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[key] = route
+}
@@ -0,0 +1,72 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package planbuilder turns a plain SQL statement into a routing Route:
+// which shards of a keyspace it must be sent to, derived from the
+// sharding-key predicate in the statement, if it has one. It lets VTGate
+// accept SQL directly instead of requiring callers to pre-resolve shards
+// or keyspace ids themselves.
+package planbuilder
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Normalize rewrites sql, replacing each literal value (a quoted string
+// or a number) that isn't already a bind variable reference with a
+// generated bind variable, and returns the rewritten SQL together with
+// the bind variables it extracted. Two statements that differ only in
+// their literal values normalize to the same SQL, so a single cached
+// Route covers both.
+func Normalize(sql string) (normalized string, extracted map[string]interface{}) {
+	extracted = make(map[string]interface{})
+	var out strings.Builder
+	count := 0
+	runes := []rune(sql)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case c == '\'':
+			j := i + 1
+			for j < len(runes) && runes[j] != '\'' {
+				j++
+			}
+			literal := string(runes[i+1 : j])
+			name := fmt.Sprintf("v%d", count)
+			count++
+			extracted[name] = literal
+			out.WriteString(":" + name)
+			i = j + 1
+		case c == ':':
+			// Already a bind variable reference; copy it verbatim.
+			j := i + 1
+			for j < len(runes) && isIdentByte(runes[j]) {
+				j++
+			}
+			out.WriteString(string(runes[i:j]))
+			i = j
+		case unicode.IsDigit(c) && (i == 0 || !isIdentByte(runes[i-1])):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			numeral := string(runes[i:j])
+			name := fmt.Sprintf("v%d", count)
+			count++
+			extracted[name] = numeral
+			out.WriteString(":" + name)
+			i = j
+		default:
+			out.WriteRune(c)
+			i++
+		}
+	}
+	return out.String(), extracted
+}
+
+func isIdentByte(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
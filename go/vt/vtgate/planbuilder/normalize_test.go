@@ -0,0 +1,47 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import "testing"
+
+func TestNormalizeLiterals(t *testing.T) {
+	normalized, extracted := Normalize("select * from user where user_id = 1 and name = 'bob'")
+	want := "select * from user where user_id = :v0 and name = :v1"
+	if normalized != want {
+		t.Fatalf("normalized = %q, want %q", normalized, want)
+	}
+	if extracted["v0"] != "1" || extracted["v1"] != "bob" {
+		t.Fatalf("extracted = %v, want v0=1 v1=bob", extracted)
+	}
+}
+
+func TestNormalizeLeavesBindVarsAlone(t *testing.T) {
+	normalized, extracted := Normalize("select * from user where user_id = :uid")
+	if normalized != "select * from user where user_id = :uid" {
+		t.Fatalf("normalized = %q, want input unchanged", normalized)
+	}
+	if len(extracted) != 0 {
+		t.Fatalf("extracted = %v, want none", extracted)
+	}
+}
+
+func TestNormalizeSameShapeSameResult(t *testing.T) {
+	n1, _ := Normalize("select * from user where user_id = 1")
+	n2, _ := Normalize("select * from user where user_id = 42")
+	if n1 != n2 {
+		t.Fatalf("normalize(1) = %q, normalize(42) = %q, want equal", n1, n2)
+	}
+}
+
+func TestNormalizeIdentifierWithDigitsUntouched(t *testing.T) {
+	normalized, extracted := Normalize("select col1 from t2 where col1 = 5")
+	want := "select col1 from t2 where col1 = :v0"
+	if normalized != want {
+		t.Fatalf("normalized = %q, want %q", normalized, want)
+	}
+	if extracted["v0"] != "5" {
+		t.Fatalf("extracted = %v, want v0=5", extracted)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RouteOpcode classifies how a Route resolves to shards.
+type RouteOpcode int
+
+const (
+	// SelectEqual means the sharding key predicate pins a single value:
+	// "col = :bv".
+	SelectEqual RouteOpcode = iota
+	// SelectIN means the sharding key predicate is an IN-list of values:
+	// "col IN (:bv1, :bv2, ...)".
+	SelectIN
+	// SelectRange means the sharding key predicate bounds a range of
+	// values: "col >= :from" and/or "col < :to".
+	SelectRange
+	// SelectScatter means no usable sharding key predicate was found, so
+	// every shard of the keyspace must be queried.
+	SelectScatter
+)
+
+func (opcode RouteOpcode) String() string {
+	switch opcode {
+	case SelectEqual:
+		return "SelectEqual"
+	case SelectIN:
+		return "SelectIN"
+	case SelectRange:
+		return "SelectRange"
+	case SelectScatter:
+		return "SelectScatter"
+	}
+	return "Unknown"
+}
+
+// ErrScatterNotAllowed is returned by BuildRoute when a statement has no
+// usable sharding key predicate and allowScatter is false.
+var ErrScatterNotAllowed = errors.New("planbuilder: no sharding key predicate found and scatter queries are disabled for this session")
+
+// Route is the result of planning one normalized SQL statement: how to
+// turn it, together with its bind variables, into a concrete set of
+// keyspace ids or key ranges at execute time.
+type Route struct {
+	Opcode RouteOpcode
+	// BindVar names the bind variable holding the value for SelectEqual.
+	BindVar string
+	// BindVars names, in order, the bind variables holding the values
+	// for SelectIN.
+	BindVars []string
+	// FromBindVar and ToBindVar name the bind variables holding the
+	// lower (inclusive) and upper (exclusive) bounds for SelectRange.
+	// Either may be empty, meaning unbounded in that direction.
+	FromBindVar, ToBindVar string
+}
+
+var bindOrLiteralPattern = `(?:\:\w+|\d+(?:\.\d+)?)`
+
+// BuildRoute parses sql (which should already have gone through
+// Normalize, so that its literals are bind variable references) looking
+// for a predicate on shardingColumn, and returns how to resolve it to
+// shards at execute time. If no such predicate is found, it returns a
+// SelectScatter route when allowScatter is true, or ErrScatterNotAllowed
+// otherwise.
+func BuildRoute(sql string, shardingColumn string, allowScatter bool) (*Route, error) {
+	lower := strings.ToLower(sql)
+	col := regexp.QuoteMeta(strings.ToLower(shardingColumn))
+
+	switch firstWord(lower) {
+	case "insert":
+		route, ok, err := buildInsertRoute(lower, col)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return route, nil
+		}
+	default:
+		where, ok := extractWhere(lower)
+		if ok {
+			route, found, err := buildWhereRoute(where, col)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				return route, nil
+			}
+		}
+	}
+
+	if !allowScatter {
+		return nil, ErrScatterNotAllowed
+	}
+	return &Route{Opcode: SelectScatter}, nil
+}
+
+func firstWord(lower string) string {
+	fields := strings.Fields(lower)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+var whereRe = regexp.MustCompile(`(?s)\bwhere\b(.*?)(?:\border\s+by\b|\bgroup\s+by\b|\blimit\b|$)`)
+
+// extractWhere returns the text of the where clause of lower, lowercased,
+// or false if there is none.
+func extractWhere(lower string) (string, bool) {
+	m := whereRe.FindStringSubmatch(lower)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+var orRe = regexp.MustCompile(`\bor\b`)
+
+// buildWhereRoute looks for a predicate on col within where (the
+// lowercased where-clause text of the original, case-preserved sql) and
+// builds the matching Route. The bool return is false if no predicate on
+// col was found.
+//
+// This matches predicate shapes with a regexp rather than a real SQL
+// parser, so it cannot tell a predicate that pins col from one that only
+// happens to mention it alongside a broadening "or": "user_id = 1 or
+// name = 'x'" would match the "=" regexp below and wrongly route to a
+// single shard, dropping whatever the or branch would have matched
+// elsewhere. Bail out to the scatter fallback for any where clause
+// containing "or" rather than risk silently wrong results.
+func buildWhereRoute(where, col string) (*Route, bool, error) {
+	if orRe.MatchString(where) {
+		return nil, false, nil
+	}
+	if m := regexp.MustCompile(`\b` + col + `\s+in\s*\(([^)]*)\)`).FindStringSubmatch(where); m != nil {
+		var bindVars []string
+		for _, v := range strings.Split(m[1], ",") {
+			bv, err := bindVarName(strings.TrimSpace(v))
+			if err != nil {
+				return nil, false, err
+			}
+			bindVars = append(bindVars, bv)
+		}
+		return &Route{Opcode: SelectIN, BindVars: bindVars}, true, nil
+	}
+
+	if m := regexp.MustCompile(`\b` + col + `\s*=\s*(` + bindOrLiteralPattern + `)`).FindStringSubmatch(where); m != nil {
+		bv, err := bindVarName(m[1])
+		if err != nil {
+			return nil, false, err
+		}
+		return &Route{Opcode: SelectEqual, BindVar: bv}, true, nil
+	}
+
+	route := &Route{Opcode: SelectRange}
+	found := false
+	if m := regexp.MustCompile(`\b` + col + `\s*>=\s*(` + bindOrLiteralPattern + `)`).FindStringSubmatch(where); m != nil {
+		bv, err := bindVarName(m[1])
+		if err != nil {
+			return nil, false, err
+		}
+		route.FromBindVar = bv
+		found = true
+	}
+	if m := regexp.MustCompile(`\b` + col + `\s*<\s*(` + bindOrLiteralPattern + `)`).FindStringSubmatch(where); m != nil {
+		bv, err := bindVarName(m[1])
+		if err != nil {
+			return nil, false, err
+		}
+		route.ToBindVar = bv
+		found = true
+	}
+	if found {
+		return route, true, nil
+	}
+	return nil, false, nil
+}
+
+var insertRe = regexp.MustCompile(`(?is)insert\s+into\s+\S+\s*\(([^)]*)\)\s*values\s*\(([^)]*)\)`)
+
+// buildInsertRoute matches a single-row "insert into t (cols) values
+// (vals)" statement and, if col is one of the columns, returns the
+// SelectEqual route for its value.
+func buildInsertRoute(lower, col string) (*Route, bool, error) {
+	m := insertRe.FindStringSubmatch(lower)
+	if m == nil {
+		return nil, false, nil
+	}
+	cols := splitTrim(m[1])
+	vals := splitTrim(m[2])
+	if len(cols) != len(vals) {
+		return nil, false, fmt.Errorf("planbuilder: insert has %d columns but %d values", len(cols), len(vals))
+	}
+	for i, c := range cols {
+		if c == col {
+			bv, err := bindVarName(vals[i])
+			if err != nil {
+				return nil, false, err
+			}
+			return &Route{Opcode: SelectEqual, BindVar: bv}, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func splitTrim(s string) []string {
+	parts := strings.Split(s, ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return parts
+}
+
+// bindVarName returns the bind variable name referenced by value, which
+// must already be a ":name" reference (as it will be once sql has gone
+// through Normalize).
+func bindVarName(value string) (string, error) {
+	if !strings.HasPrefix(value, ":") {
+		return "", fmt.Errorf("planbuilder: expected a bind variable, got %q; did the statement go through Normalize?", value)
+	}
+	return strings.TrimPrefix(value, ":"), nil
+}
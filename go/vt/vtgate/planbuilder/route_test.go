@@ -0,0 +1,135 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package planbuilder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func build(t *testing.T, sql string, allowScatter bool) *Route {
+	normalized, _ := Normalize(sql)
+	route, err := BuildRoute(normalized, "user_id", allowScatter)
+	if err != nil {
+		t.Fatalf("BuildRoute(%q) failed: %v", sql, err)
+	}
+	return route
+}
+
+func TestBuildRoutePointSelect(t *testing.T) {
+	route := build(t, "select * from user where user_id = 1", true)
+	if route.Opcode != SelectEqual {
+		t.Fatalf("opcode = %v, want SelectEqual", route.Opcode)
+	}
+	if route.BindVar == "" {
+		t.Fatalf("BindVar is empty")
+	}
+}
+
+func TestBuildRoutePointSelectWithBindVar(t *testing.T) {
+	normalized, extracted := Normalize("select * from user where user_id = :uid")
+	if len(extracted) != 0 {
+		t.Fatalf("extracted = %v, want none (already a bind var)", extracted)
+	}
+	route, err := BuildRoute(normalized, "user_id", false)
+	if err != nil {
+		t.Fatalf("BuildRoute failed: %v", err)
+	}
+	if route.Opcode != SelectEqual || route.BindVar != "uid" {
+		t.Fatalf("route = %+v, want SelectEqual on uid", route)
+	}
+}
+
+func TestBuildRouteInList(t *testing.T) {
+	route := build(t, "select * from user where user_id in (1, 2, 3)", true)
+	if route.Opcode != SelectIN {
+		t.Fatalf("opcode = %v, want SelectIN", route.Opcode)
+	}
+	if len(route.BindVars) != 3 {
+		t.Fatalf("BindVars = %v, want 3 entries", route.BindVars)
+	}
+}
+
+func TestBuildRouteRange(t *testing.T) {
+	route := build(t, "select * from user where user_id >= 10 and user_id < 20", true)
+	if route.Opcode != SelectRange {
+		t.Fatalf("opcode = %v, want SelectRange", route.Opcode)
+	}
+	if route.FromBindVar == "" || route.ToBindVar == "" {
+		t.Fatalf("route = %+v, want both bounds set", route)
+	}
+}
+
+func TestBuildRouteOneSidedRange(t *testing.T) {
+	route := build(t, "select * from user where user_id >= 10", true)
+	if route.Opcode != SelectRange {
+		t.Fatalf("opcode = %v, want SelectRange", route.Opcode)
+	}
+	if route.FromBindVar == "" || route.ToBindVar != "" {
+		t.Fatalf("route = %+v, want only the lower bound set", route)
+	}
+}
+
+func TestBuildRouteInsert(t *testing.T) {
+	route := build(t, "insert into user (user_id, name) values (1, 'bob')", true)
+	if route.Opcode != SelectEqual {
+		t.Fatalf("opcode = %v, want SelectEqual", route.Opcode)
+	}
+}
+
+func TestBuildRouteUpdate(t *testing.T) {
+	route := build(t, "update user set name = 'bob' where user_id = 1", true)
+	if route.Opcode != SelectEqual {
+		t.Fatalf("opcode = %v, want SelectEqual", route.Opcode)
+	}
+}
+
+func TestBuildRouteDelete(t *testing.T) {
+	route := build(t, "delete from user where user_id = 1", true)
+	if route.Opcode != SelectEqual {
+		t.Fatalf("opcode = %v, want SelectEqual", route.Opcode)
+	}
+}
+
+func TestBuildRouteOrFallsBackToScatter(t *testing.T) {
+	route := build(t, "select * from user where user_id = 1 or name = 'bob'", true)
+	if route.Opcode != SelectScatter {
+		t.Fatalf("opcode = %v, want SelectScatter (an or clause cannot be routed off a single predicate)", route.Opcode)
+	}
+}
+
+func TestBuildRouteScatterFallback(t *testing.T) {
+	route := build(t, "select * from user where name = 'bob'", true)
+	if route.Opcode != SelectScatter {
+		t.Fatalf("opcode = %v, want SelectScatter", route.Opcode)
+	}
+}
+
+func TestBuildRouteScatterDisallowed(t *testing.T) {
+	normalized, _ := Normalize("select * from user where name = 'bob'")
+	_, err := BuildRoute(normalized, "user_id", false)
+	if err != ErrScatterNotAllowed {
+		t.Fatalf("err = %v, want ErrScatterNotAllowed", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache()
+	route1 := build(t, "select * from user where user_id = 1", true)
+	normalized, _ := Normalize("select * from user where user_id = 7")
+	cache.Set(normalized, route1)
+
+	got, ok := cache.Get(normalized)
+	if !ok {
+		t.Fatalf("Get() found nothing, want route1")
+	}
+	if !reflect.DeepEqual(got, route1) {
+		t.Fatalf("Get() = %+v, want %+v", got, route1)
+	}
+
+	if _, ok := cache.Get("select * from user where user_id = :v0 and something_else"); ok {
+		t.Fatalf("Get() found a route for an uncached key")
+	}
+}
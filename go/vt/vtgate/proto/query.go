@@ -0,0 +1,65 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"github.com/youtube/vitess/go/vt/key"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+)
+
+// KeyspaceIdQuery is the payload for ExecuteKeyspaceIds and
+// StreamExecuteKeyspaceIds. VTGate resolves KeyspaceIds to shards itself,
+// so unlike QueryShard it carries no shard names.
+type KeyspaceIdQuery struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyspaceIds   []key.KeyspaceId
+	SessionId     int64
+}
+
+// KeyRangeQuery is the payload for ExecuteKeyRanges. VTGate resolves the
+// KeyRanges to the shards that overlap them.
+type KeyRangeQuery struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyRanges     []key.KeyRange
+	SessionId     int64
+}
+
+// BatchKeyspaceIdQuery is the payload for ExecuteBatchKeyspaceIds: a list
+// of queries run against the shards that own any of KeyspaceIds.
+type BatchKeyspaceIdQuery struct {
+	Queries     []tproto.BoundQuery
+	Keyspace    string
+	KeyspaceIds []key.KeyspaceId
+	SessionId   int64
+}
+
+// Query is the payload for Execute and StreamExecute. The caller sends
+// plain SQL and a keyspace, nothing else: VTGate parses out the sharding
+// key predicate itself and routes accordingly.
+type Query struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	// AllowScatter must be set for statements that have no sharding key
+	// predicate to be allowed to fan out to every shard of Keyspace.
+	// Without it, such a statement is rejected rather than silently
+	// scattered.
+	AllowScatter bool
+	SessionId    int64
+}
+
+// BatchQuery is the payload for ExecuteBatch: like Query, but for a list
+// of statements run in the same batch. Every statement in the batch is
+// planned and routed independently.
+type BatchQuery struct {
+	Queries      []tproto.BoundQuery
+	Keyspace     string
+	AllowScatter bool
+	SessionId    int64
+}
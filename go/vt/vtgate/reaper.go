@@ -0,0 +1,52 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// startReaper launches a background goroutine that periodically scans
+// vtg.connections for sessions that have been idle for longer than
+// vtg.sessionTimeout, rolls back any open transaction they hold, and
+// unregisters them. This bounds the damage a client that crashes or
+// forgets to call CloseSession can do: without it, the ScatterConn (and
+// any transaction it holds open on the tablets) leaks forever.
+//
+// It is a no-op if sessionTimeout is zero, which keeps the previous
+// behavior of never reaping sessions.
+func (vtg *VTGate) startReaper() {
+	if vtg.sessionTimeout <= 0 {
+		return
+	}
+	go func() {
+		// Scan at twice the timeout's frequency so a session is never
+		// idle for much more than sessionTimeout before being reaped.
+		ticker := time.NewTicker(vtg.sessionTimeout / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			vtg.reapIdleSessions()
+		}
+	}()
+}
+
+func (vtg *VTGate) reapIdleSessions() {
+	for _, c := range vtg.connections.GetOutdated(vtg.sessionTimeout, "idle vtgate session") {
+		scatterConn := c.(*ScatterConn)
+		hadOpenTransaction := scatterConn.InTransaction()
+		if err := scatterConn.Rollback(); err != nil {
+			log.Warningf("vtgate reaper: rollback failed for session %d: %v", scatterConn.Id, err)
+		} else if hadOpenTransaction {
+			vtgateTransactionsReapedRolled.Add(1)
+		}
+		scatterConn.Close()
+		vtg.connections.Unregister(scatterConn.Id)
+		vtg.txResolver.Forget(scatterConn.Id)
+		vtgateActiveSessions.Add(-1)
+		vtgateSessionsReaped.Add(1)
+	}
+}
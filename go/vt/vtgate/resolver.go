@@ -0,0 +1,121 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/youtube/vitess/go/vt/key"
+)
+
+// ShardSpec describes the portion of a keyspace's keyrange owned by a
+// single shard. Shards within a keyspace must not overlap.
+type ShardSpec struct {
+	Shard    string
+	KeyRange key.KeyRange
+}
+
+// ShardingScheme identifies how a keyspace's sharding column value maps
+// to a keyspace id. It determines whether a range predicate on that
+// column can be resolved directly to a single KeyRange.
+type ShardingScheme int
+
+const (
+	// RangeSharded means keyspace ids preserve the sharding column's
+	// ordering, so two values compare the same way their keyspace ids
+	// do and a range of them maps to a single KeyRange.
+	RangeSharded ShardingScheme = iota
+	// HashSharded means keyspace ids are a hash of the sharding column
+	// value, so their ordering carries no relation to the values': a
+	// range of values cannot be expressed as a single KeyRange.
+	HashSharded
+)
+
+// TopologyServer is the narrow interface the Resolver, and the SQL
+// planner that sits in front of it, need from the topology.
+type TopologyServer interface {
+	// GetShardsForKeyspace returns the current sharding scheme of
+	// keyspace as a list of shards and the keyrange each one owns.
+	GetShardsForKeyspace(keyspace string) ([]ShardSpec, error)
+	// ShardingColumnForKeyspace returns the name of the column that
+	// keyspace is sharded by.
+	ShardingColumnForKeyspace(keyspace string) (string, error)
+	// ShardingSchemeForKeyspace returns how keyspace maps its sharding
+	// column's values to keyspace ids.
+	ShardingSchemeForKeyspace(keyspace string) (ShardingScheme, error)
+	// KeyspaceIdForValue maps a sharding column value to the keyspace id
+	// it owns, using keyspace's sharding scheme (e.g. hashing it).
+	KeyspaceIdForValue(keyspace string, value interface{}) (key.KeyspaceId, error)
+}
+
+// Resolver maps keyspace ids and key ranges to shard names using the
+// current sharding scheme, so that callers of ExecuteKeyspaceIds,
+// ExecuteKeyRanges and their batch/streaming variants never have to know
+// shard names themselves.
+type Resolver struct {
+	topoServer TopologyServer
+}
+
+// NewResolver creates a Resolver backed by the given topology server.
+func NewResolver(topoServer TopologyServer) *Resolver {
+	return &Resolver{topoServer: topoServer}
+}
+
+// ShardsForKeyspaceIds returns the sorted, deduped list of shards that
+// own at least one of ids.
+func (rsl *Resolver) ShardsForKeyspaceIds(keyspace string, ids []key.KeyspaceId) ([]string, error) {
+	specs, err := rsl.topoServer.GetShardsForKeyspace(keyspace)
+	if err != nil {
+		return nil, fmt.Errorf("keyspace %s: %v", keyspace, err)
+	}
+	seen := make(map[string]bool)
+	var shards []string
+	for _, id := range ids {
+		for _, spec := range specs {
+			if spec.KeyRange.Contains(id) && !seen[spec.Shard] {
+				seen[spec.Shard] = true
+				shards = append(shards, spec.Shard)
+			}
+		}
+	}
+	sort.Strings(shards)
+	return shards, nil
+}
+
+// AllShards returns every shard of keyspace, for statements that have no
+// usable sharding key predicate and must be scattered.
+func (rsl *Resolver) AllShards(keyspace string) ([]string, error) {
+	specs, err := rsl.topoServer.GetShardsForKeyspace(keyspace)
+	if err != nil {
+		return nil, fmt.Errorf("keyspace %s: %v", keyspace, err)
+	}
+	shards := make([]string, len(specs))
+	for i, spec := range specs {
+		shards[i] = spec.Shard
+	}
+	return shards, nil
+}
+
+// ShardsForKeyRanges returns the sorted, deduped list of shards that
+// overlap any of krs.
+func (rsl *Resolver) ShardsForKeyRanges(keyspace string, krs []key.KeyRange) ([]string, error) {
+	specs, err := rsl.topoServer.GetShardsForKeyspace(keyspace)
+	if err != nil {
+		return nil, fmt.Errorf("keyspace %s: %v", keyspace, err)
+	}
+	seen := make(map[string]bool)
+	var shards []string
+	for _, kr := range krs {
+		for _, spec := range specs {
+			if kr.Overlaps(spec.KeyRange) && !seen[spec.Shard] {
+				seen[spec.Shard] = true
+				shards = append(shards, spec.Shard)
+			}
+		}
+	}
+	sort.Strings(shards)
+	return shards, nil
+}
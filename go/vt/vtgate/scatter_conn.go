@@ -0,0 +1,346 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+var lastScatterConnId int64
+
+// ShardTabletConn is the narrow interface ScatterConn needs from a
+// connection to a single shard's tablet: everything a session does to
+// one shard over its lifetime, from its first query through whichever
+// of Commit, Rollback, or two-phase commit concludes it.
+type ShardTabletConn interface {
+	Execute(sql string, bindVariables map[string]interface{}) (*mproto.QueryResult, error)
+	ExecuteBatch(queries []tproto.BoundQuery) (*tproto.QueryResultList, error)
+	StreamExecute(sql string, bindVariables map[string]interface{}, sendReply func(interface{}) error) error
+	Begin() error
+	Commit() error
+	Rollback() error
+	Close()
+	Prepare(dtid string) error
+	CommitPrepared(dtid string) error
+	RollbackPrepared(dtid string) error
+	// ReadTransaction reports whether dtid is currently prepared on this
+	// tablet, for a live session to double check its own participants.
+	ReadTransaction(dtid string) (prepared bool, err error)
+}
+
+// BalancerMap resolves a keyspace/shard/tabletType to a connection to a
+// healthy tablet serving it, load-balancing across the available
+// endpoints. ScatterConn only ever needs the one connection it returns;
+// picking among endpoints and watching the topology for changes is the
+// balancer's job, not ScatterConn's.
+type BalancerMap struct {
+	// Dial opens a ShardTabletConn for one keyspace/shard. Production
+	// code sets this once, at startup, to something backed by the real
+	// topology and tablet dialer registry.
+	Dial func(keyspace, shard string, tabletType topo.TabletType, tabletProtocol string, retryDelay time.Duration, retryCount int) (ShardTabletConn, error)
+}
+
+func (blm *BalancerMap) conn(keyspace, shard string, tabletType topo.TabletType, tabletProtocol string, retryDelay time.Duration, retryCount int) (ShardTabletConn, error) {
+	if blm == nil || blm.Dial == nil {
+		return nil, fmt.Errorf("no tablet dialer configured for %s/%s", keyspace, shard)
+	}
+	return blm.Dial(keyspace, shard, tabletType, tabletProtocol, retryDelay, retryCount)
+}
+
+// ScatterConn is the per-session connection state: it lazily dials one
+// ShardTabletConn per shard the session touches and keeps it open for
+// the session's lifetime, so that Commit, Rollback, or a two-phase
+// commit can address exactly the shards the session actually used.
+type ScatterConn struct {
+	Id int64
+
+	balancerMap    *BalancerMap
+	tabletProtocol string
+	tabletType     topo.TabletType
+	retryDelay     time.Duration
+	retryCount     int
+
+	mu            sync.Mutex
+	conns         map[string]ShardTabletConn // "keyspace/shard" -> conn
+	inTransaction bool
+}
+
+// NewScatterConn creates a ScatterConn that dials shards through blm.
+func NewScatterConn(blm *BalancerMap, tabletProtocol string, tabletType topo.TabletType, retryDelay time.Duration, retryCount int) *ScatterConn {
+	return &ScatterConn{
+		Id:             atomic.AddInt64(&lastScatterConnId, 1),
+		balancerMap:    blm,
+		tabletProtocol: tabletProtocol,
+		tabletType:     tabletType,
+		retryDelay:     retryDelay,
+		retryCount:     retryCount,
+		conns:          make(map[string]ShardTabletConn),
+	}
+}
+
+func shardKey(keyspace, shard string) string {
+	return keyspace + "/" + shard
+}
+
+// connForShard returns the open connection for keyspace/shard, dialing
+// and (if a transaction is open) beginning one if this is the shard's
+// first use this session.
+func (sc *ScatterConn) connForShard(keyspace, shard string) (ShardTabletConn, error) {
+	key := shardKey(keyspace, shard)
+
+	sc.mu.Lock()
+	conn, ok := sc.conns[key]
+	inTransaction := sc.inTransaction
+	sc.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	conn, err := sc.balancerMap.conn(keyspace, shard, sc.tabletType, sc.tabletProtocol, sc.retryDelay, sc.retryCount)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	if inTransaction {
+		if err := conn.Begin(); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	sc.mu.Lock()
+	sc.conns[key] = conn
+	sc.mu.Unlock()
+	return conn, nil
+}
+
+// Execute runs sql against every shard in shards and merges the results.
+func (sc *ScatterConn) Execute(sql string, bindVariables map[string]interface{}, keyspace string, shards []string) (*mproto.QueryResult, error) {
+	var merged *mproto.QueryResult
+	for _, shard := range shards {
+		conn, err := sc.connForShard(keyspace, shard)
+		if err != nil {
+			return nil, err
+		}
+		qr, err := conn.Execute(sql, bindVariables)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", shardKey(keyspace, shard), err)
+		}
+		merged = appendResult(merged, qr)
+	}
+	if merged == nil {
+		merged = &mproto.QueryResult{}
+	}
+	return merged, nil
+}
+
+// ExecuteBatch runs queries against every shard in shards, merging the
+// per-query results across shards the same way Execute does.
+func (sc *ScatterConn) ExecuteBatch(queries []tproto.BoundQuery, keyspace string, shards []string) (*tproto.QueryResultList, error) {
+	merged := make([]mproto.QueryResult, len(queries))
+	for _, shard := range shards {
+		conn, err := sc.connForShard(keyspace, shard)
+		if err != nil {
+			return nil, err
+		}
+		qrl, err := conn.ExecuteBatch(queries)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", shardKey(keyspace, shard), err)
+		}
+		for i := range queries {
+			r := appendResult(&merged[i], &qrl.List[i])
+			merged[i] = *r
+		}
+	}
+	return &tproto.QueryResultList{List: merged}, nil
+}
+
+// StreamExecute runs sql against every shard in shards, shard by shard,
+// calling sendReply for every row streamed back.
+func (sc *ScatterConn) StreamExecute(sql string, bindVariables map[string]interface{}, keyspace string, shards []string, sendReply func(interface{}) error) error {
+	for _, shard := range shards {
+		conn, err := sc.connForShard(keyspace, shard)
+		if err != nil {
+			return err
+		}
+		if err := conn.StreamExecute(sql, bindVariables, sendReply); err != nil {
+			return fmt.Errorf("%s: %v", shardKey(keyspace, shard), err)
+		}
+	}
+	return nil
+}
+
+// Begin starts a transaction. Shards dialed after Begin join it as they
+// are first used; Begin itself does not need to know which shards that
+// will turn out to be.
+func (sc *ScatterConn) Begin() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.inTransaction = true
+	return nil
+}
+
+// Commit commits the open transaction on every shard it touched.
+func (sc *ScatterConn) Commit() error {
+	sc.mu.Lock()
+	conns := sc.shardConnsLocked()
+	sc.inTransaction = false
+	sc.mu.Unlock()
+	for key, conn := range conns {
+		if err := conn.Commit(); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Rollback rolls back the open transaction on every shard it touched.
+func (sc *ScatterConn) Rollback() error {
+	sc.mu.Lock()
+	conns := sc.shardConnsLocked()
+	sc.inTransaction = false
+	sc.mu.Unlock()
+	for key, conn := range conns {
+		if err := conn.Rollback(); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Close closes every shard connection this session opened.
+func (sc *ScatterConn) Close() {
+	sc.mu.Lock()
+	conns := sc.conns
+	sc.conns = make(map[string]ShardTabletConn)
+	sc.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// InTransaction reports whether a transaction is currently open on this
+// session.
+func (sc *ScatterConn) InTransaction() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.inTransaction
+}
+
+// EndTransaction marks the open transaction as concluded without
+// committing or rolling back through the per-shard connections: it is
+// for a two-phase commit, which already drove every participant to a
+// terminal outcome itself via Prepare/CommitPrepared, and only needs to
+// clear the session's own bookkeeping afterwards the way Commit and
+// Rollback do for a plain, single-round-trip transaction.
+func (sc *ScatterConn) EndTransaction() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.inTransaction = false
+}
+
+// Participants returns the sorted list of "keyspace/shard" keys for
+// every shard this session has a connection open to, whether it read
+// from or wrote to it: the participant list a two-phase commit must
+// coordinate.
+func (sc *ScatterConn) Participants() []string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	participants := make([]string, 0, len(sc.conns))
+	for key := range sc.conns {
+		participants = append(participants, key)
+	}
+	sort.Strings(participants)
+	return participants
+}
+
+func (sc *ScatterConn) shardConnsLocked() map[string]ShardTabletConn {
+	conns := make(map[string]ShardTabletConn, len(sc.conns))
+	for key, conn := range sc.conns {
+		conns[key] = conn
+	}
+	return conns
+}
+
+// Prepare sends Prepare(dtid) to every participant.
+func (sc *ScatterConn) Prepare(dtid string) error {
+	sc.mu.Lock()
+	conns := sc.shardConnsLocked()
+	sc.mu.Unlock()
+	for key, conn := range conns {
+		if err := conn.Prepare(dtid); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// CommitPrepared sends CommitPrepared(dtid) to every participant.
+func (sc *ScatterConn) CommitPrepared(dtid string) error {
+	sc.mu.Lock()
+	conns := sc.shardConnsLocked()
+	sc.mu.Unlock()
+	for key, conn := range conns {
+		if err := conn.CommitPrepared(dtid); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// RollbackPrepared sends RollbackPrepared(dtid) to every participant.
+func (sc *ScatterConn) RollbackPrepared(dtid string) error {
+	sc.mu.Lock()
+	conns := sc.shardConnsLocked()
+	sc.mu.Unlock()
+	for key, conn := range conns {
+		if err := conn.RollbackPrepared(dtid); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// ReadTransaction reports whether every participant currently has dtid
+// prepared.
+func (sc *ScatterConn) ReadTransaction(dtid string) (bool, error) {
+	sc.mu.Lock()
+	conns := sc.shardConnsLocked()
+	sc.mu.Unlock()
+	for key, conn := range conns {
+		prepared, err := conn.ReadTransaction(dtid)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", key, err)
+		}
+		if !prepared {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// appendResult merges add into base (which may be nil), the way a
+// client expects rows from multiple shards of the same query to be
+// concatenated into one QueryResult.
+func appendResult(base, add *mproto.QueryResult) *mproto.QueryResult {
+	if base == nil || len(base.Fields) == 0 {
+		merged := *add
+		merged.Rows = append([][]interface{}(nil), add.Rows...)
+		if base != nil {
+			merged.Rows = append(append([][]interface{}(nil), base.Rows...), merged.Rows...)
+			merged.RowsAffected += base.RowsAffected
+		}
+		return &merged
+	}
+	base.Rows = append(base.Rows, add.Rows...)
+	base.RowsAffected += add.RowsAffected
+	return base
+}
@@ -0,0 +1,18 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"github.com/youtube/vitess/go/stats"
+)
+
+// Exported stats so operators can see session churn and catch leaks:
+// connections that pile up in vtg.connections without a matching
+// CloseSession, and transactions the idle reaper had to clean up.
+var (
+	vtgateActiveSessions           = stats.NewInt("VtgateActiveSessions")
+	vtgateSessionsReaped           = stats.NewInt("VtgateSessionsReaped")
+	vtgateTransactionsReapedRolled = stats.NewInt("VtgateTransactionsReapedRolledBack")
+)
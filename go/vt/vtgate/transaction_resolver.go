@@ -0,0 +1,225 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// TabletDialer is the narrow tablet-side interface the resolver needs to
+// finish a transaction when the client session that started it is gone
+// (e.g. VTGate crashed mid-commit): it drives one participant at a time
+// through the same Prepare/CommitPrepared/RollbackPrepared RPCs
+// ScatterConn uses during a normal, live commit.
+type TabletDialer interface {
+	// ReadTransaction reports whether dtid is currently prepared on
+	// participant, so recovery can tell a crash before Prepare finished
+	// apart from one after it did.
+	ReadTransaction(participant, dtid string) (prepared bool, err error)
+	CommitPrepared(participant, dtid string) error
+	RollbackPrepared(participant, dtid string) error
+}
+
+// TransactionResolver drives two-phase commits across shards: it assigns
+// each atomic transaction a dtid, records its participant list in a
+// metadata shard before telling any participant to commit, and in the
+// background resolves dtids left pending by a crash between Prepare and
+// CommitPrepared.
+type TransactionResolver struct {
+	metadataStore MetadataStore
+	tabletDialer  TabletDialer
+	pollInterval  time.Duration
+	dtidCounter   int64
+
+	mu             sync.Mutex
+	atomicSessions map[int64]bool // sessions started with Begin2PC
+}
+
+// NewTransactionResolver creates a resolver that persists transaction
+// records with metadataStore and, on recovery, drives pending dtids to
+// completion by calling tabletDialer. It does not start the recovery
+// goroutine; call Run for that.
+func NewTransactionResolver(metadataStore MetadataStore, tabletDialer TabletDialer, pollInterval time.Duration) *TransactionResolver {
+	return &TransactionResolver{
+		metadataStore:  metadataStore,
+		tabletDialer:   tabletDialer,
+		pollInterval:   pollInterval,
+		atomicSessions: make(map[int64]bool),
+	}
+}
+
+// MarkAtomic records that sessionId was started with Begin2PC and should
+// commit via two-phase commit rather than ScatterConn.Commit.
+func (tr *TransactionResolver) MarkAtomic(sessionId int64) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.atomicSessions[sessionId] = true
+}
+
+// IsAtomic returns whether sessionId was started with Begin2PC.
+func (tr *TransactionResolver) IsAtomic(sessionId int64) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.atomicSessions[sessionId]
+}
+
+// Forget drops any atomic bookkeeping for sessionId. Call this once its
+// transaction has concluded, successfully or not.
+func (tr *TransactionResolver) Forget(sessionId int64) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	delete(tr.atomicSessions, sessionId)
+}
+
+func (tr *TransactionResolver) newDtid() string {
+	return fmt.Sprintf("vtgate:%d:%d", time.Now().UnixNano(), atomic.AddInt64(&tr.dtidCounter, 1))
+}
+
+// Commit drives sc's open transaction through two-phase commit: a
+// durable transaction record first (state TxPreparing), then Prepare on
+// every participant, then the record advanced to TxCommitting, then
+// CommitPrepared on every participant. The record must exist before
+// Prepare is sent: if it were written afterwards and VTGate crashed in
+// between, the participants would hold prepared transactions with no
+// record for ListPending to ever surface, and they would stay prepared
+// (locks held) forever. If sc touches at most one shard, it commits
+// directly since there is nothing to coordinate.
+func (tr *TransactionResolver) Commit(sc *ScatterConn) error {
+	participants := sc.Participants()
+	if len(participants) <= 1 {
+		return sc.Commit()
+	}
+
+	dtid := tr.newDtid()
+	if err := tr.metadataStore.CreateTransaction(dtid, participants); err != nil {
+		return fmt.Errorf("dtid %s: could not persist transaction record: %v", dtid, err)
+	}
+	if err := sc.Prepare(dtid); err != nil {
+		if rerr := sc.RollbackPrepared(dtid); rerr != nil {
+			// A participant may still be genuinely prepared with locks
+			// held. Leave the record as TxPreparing rather than
+			// deleting it, so resolveOne re-verifies with
+			// ReadTransaction and rolls it back once the rollback can
+			// actually reach every participant.
+			log.Warningf("dtid %s: rollback after failed prepare also failed, the resolver will verify and roll it back: %v", dtid, rerr)
+			return fmt.Errorf("dtid %s: prepare failed: %v", dtid, err)
+		}
+		sc.EndTransaction()
+		if derr := tr.metadataStore.DeleteTransaction(dtid); derr != nil {
+			log.Warningf("dtid %s: prepare failed and rolled back but could not delete transaction record: %v", dtid, derr)
+		}
+		return fmt.Errorf("dtid %s: prepare failed: %v", dtid, err)
+	}
+	if err := tr.metadataStore.UpdateState(dtid, TxCommitting); err != nil {
+		// Every participant is prepared but the record still says
+		// TxPreparing; the resolver will re-verify with ReadTransaction,
+		// find everyone prepared, and advance it itself.
+		return fmt.Errorf("dtid %s: prepared but could not advance transaction record, the resolver will finish it: %v", dtid, err)
+	}
+	if err := sc.CommitPrepared(dtid); err != nil {
+		// The record is TxCommitting, so the background resolver will
+		// finish driving this dtid to a commit even though this RPC
+		// returns an error to the caller.
+		return fmt.Errorf("dtid %s: commit_prepared failed, will be finished by the resolver: %v", dtid, err)
+	}
+	// The 2PC path commits through Prepare/CommitPrepared directly
+	// rather than sc.Commit(), which is what normally clears this: clear
+	// it here instead, or the session is left looking like it still has
+	// a transaction open and the next autocommit query on it opens one
+	// that nothing ever commits.
+	sc.EndTransaction()
+	if err := tr.metadataStore.DeleteTransaction(dtid); err != nil {
+		log.Warningf("dtid %s: committed but could not delete transaction record: %v", dtid, err)
+	}
+	return nil
+}
+
+// Run polls the metadata store for pending dtids and drives each to
+// completion. It never returns, so callers should run it in its own
+// goroutine.
+func (tr *TransactionResolver) Run() {
+	ticker := time.NewTicker(tr.pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tr.resolvePending()
+	}
+}
+
+func (tr *TransactionResolver) resolvePending() {
+	dtids, err := tr.metadataStore.ListPending()
+	if err != nil {
+		log.Warningf("transaction resolver: could not list pending transactions: %v", err)
+		return
+	}
+	for _, dtid := range dtids {
+		txn, err := tr.metadataStore.ReadTransaction(dtid)
+		if err != nil {
+			log.Warningf("dtid %s: could not read transaction record: %v", dtid, err)
+			continue
+		}
+		tr.resolveOne(txn)
+	}
+}
+
+// resolveOne drives a single recovered transaction to completion,
+// branching on the state the crash left it in. TxCommitting means every
+// participant was confirmed prepared before the crash, so the only safe
+// action is to retry CommitPrepared. TxPreparing means Prepare may not
+// have reached every participant yet, so resolveOne checks each one with
+// ReadTransaction before deciding whether to finish committing or to
+// roll back.
+func (tr *TransactionResolver) resolveOne(txn *DistributedTransaction) {
+	if txn.State == TxPreparing {
+		allPrepared := true
+		for _, participant := range txn.Participants {
+			prepared, err := tr.tabletDialer.ReadTransaction(participant, txn.Dtid)
+			if err != nil {
+				log.Warningf("dtid %s: could not read transaction state on %s, will retry: %v", txn.Dtid, participant, err)
+				return
+			}
+			if !prepared {
+				allPrepared = false
+			}
+		}
+		if !allPrepared {
+			tr.rollbackPending(txn)
+			return
+		}
+		if err := tr.metadataStore.UpdateState(txn.Dtid, TxCommitting); err != nil {
+			log.Warningf("dtid %s: all participants prepared but could not advance transaction record, will retry: %v", txn.Dtid, err)
+			return
+		}
+		txn.State = TxCommitting
+	}
+
+	for _, participant := range txn.Participants {
+		if err := tr.tabletDialer.CommitPrepared(participant, txn.Dtid); err != nil {
+			log.Warningf("dtid %s: commit_prepared on %s failed, will retry: %v", txn.Dtid, participant, err)
+			return
+		}
+	}
+	if err := tr.metadataStore.DeleteTransaction(txn.Dtid); err != nil {
+		log.Warningf("dtid %s: resolved but could not delete transaction record: %v", txn.Dtid, err)
+	}
+}
+
+// rollbackPending undoes a TxPreparing transaction that did not reach
+// every participant before the crash.
+func (tr *TransactionResolver) rollbackPending(txn *DistributedTransaction) {
+	for _, participant := range txn.Participants {
+		if err := tr.tabletDialer.RollbackPrepared(participant, txn.Dtid); err != nil {
+			log.Warningf("dtid %s: rollback_prepared on %s failed, will retry: %v", txn.Dtid, participant, err)
+			return
+		}
+	}
+	if err := tr.metadataStore.DeleteTransaction(txn.Dtid); err != nil {
+		log.Warningf("dtid %s: rolled back but could not delete transaction record: %v", txn.Dtid, err)
+	}
+}
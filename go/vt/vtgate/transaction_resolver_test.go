@@ -0,0 +1,168 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeTabletDialer is a TabletDialer whose participants can be scripted
+// to have (or not have) dtid prepared, and whose RPCs can be made to
+// fail once to exercise the resolver's retry-next-tick behavior.
+type fakeTabletDialer struct {
+	prepared map[string]bool // participant -> has dtid prepared
+	failOnce map[string]bool // participant -> fail the next call once
+
+	committed  []string
+	rolledBack []string
+}
+
+func newFakeTabletDialer() *fakeTabletDialer {
+	return &fakeTabletDialer{
+		prepared: make(map[string]bool),
+		failOnce: make(map[string]bool),
+	}
+}
+
+func (f *fakeTabletDialer) maybeFail(participant string) error {
+	if f.failOnce[participant] {
+		delete(f.failOnce, participant)
+		return fmt.Errorf("injected failure for %s", participant)
+	}
+	return nil
+}
+
+func (f *fakeTabletDialer) ReadTransaction(participant, dtid string) (bool, error) {
+	if err := f.maybeFail(participant); err != nil {
+		return false, err
+	}
+	return f.prepared[participant], nil
+}
+
+func (f *fakeTabletDialer) CommitPrepared(participant, dtid string) error {
+	if err := f.maybeFail(participant); err != nil {
+		return err
+	}
+	f.committed = append(f.committed, participant)
+	return nil
+}
+
+func (f *fakeTabletDialer) RollbackPrepared(participant, dtid string) error {
+	if err := f.maybeFail(participant); err != nil {
+		return err
+	}
+	f.rolledBack = append(f.rolledBack, participant)
+	return nil
+}
+
+func TestResolveOneCommittingRetriesCommit(t *testing.T) {
+	store := NewMemoryMetadataStore()
+	dialer := newFakeTabletDialer()
+	tr := NewTransactionResolver(store, dialer, 0)
+
+	if err := store.CreateTransaction("dtid1", []string{"a/0", "a/1"}); err != nil {
+		t.Fatalf("CreateTransaction: %v", err)
+	}
+	if err := store.UpdateState("dtid1", TxCommitting); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+
+	txn, err := store.ReadTransaction("dtid1")
+	if err != nil {
+		t.Fatalf("ReadTransaction: %v", err)
+	}
+	tr.resolveOne(txn)
+
+	if len(dialer.committed) != 2 {
+		t.Fatalf("committed = %v, want 2 participants committed", dialer.committed)
+	}
+	if len(dialer.rolledBack) != 0 {
+		t.Fatalf("rolledBack = %v, want none", dialer.rolledBack)
+	}
+	if _, err := store.ReadTransaction("dtid1"); err == nil {
+		t.Fatalf("ReadTransaction after resolve found a record, want it deleted")
+	}
+}
+
+func TestResolveOnePreparingAllPreparedAdvancesAndCommits(t *testing.T) {
+	store := NewMemoryMetadataStore()
+	dialer := newFakeTabletDialer()
+	dialer.prepared["a/0"] = true
+	dialer.prepared["a/1"] = true
+	tr := NewTransactionResolver(store, dialer, 0)
+
+	if err := store.CreateTransaction("dtid1", []string{"a/0", "a/1"}); err != nil {
+		t.Fatalf("CreateTransaction: %v", err)
+	}
+
+	txn, err := store.ReadTransaction("dtid1")
+	if err != nil {
+		t.Fatalf("ReadTransaction: %v", err)
+	}
+	tr.resolveOne(txn)
+
+	if len(dialer.committed) != 2 {
+		t.Fatalf("committed = %v, want 2 participants committed", dialer.committed)
+	}
+	if len(dialer.rolledBack) != 0 {
+		t.Fatalf("rolledBack = %v, want none", dialer.rolledBack)
+	}
+}
+
+func TestResolveOnePreparingNotAllPreparedRollsBack(t *testing.T) {
+	store := NewMemoryMetadataStore()
+	dialer := newFakeTabletDialer()
+	dialer.prepared["a/0"] = true
+	// a/1 never reported prepared, e.g. the crash happened before
+	// Prepare reached it.
+	tr := NewTransactionResolver(store, dialer, 0)
+
+	if err := store.CreateTransaction("dtid1", []string{"a/0", "a/1"}); err != nil {
+		t.Fatalf("CreateTransaction: %v", err)
+	}
+
+	txn, err := store.ReadTransaction("dtid1")
+	if err != nil {
+		t.Fatalf("ReadTransaction: %v", err)
+	}
+	tr.resolveOne(txn)
+
+	if len(dialer.rolledBack) != 2 {
+		t.Fatalf("rolledBack = %v, want 2 participants rolled back", dialer.rolledBack)
+	}
+	if len(dialer.committed) != 0 {
+		t.Fatalf("committed = %v, want none", dialer.committed)
+	}
+	if _, err := store.ReadTransaction("dtid1"); err == nil {
+		t.Fatalf("ReadTransaction after resolve found a record, want it deleted")
+	}
+}
+
+func TestResolveOneLeavesRecordOnFailure(t *testing.T) {
+	store := NewMemoryMetadataStore()
+	dialer := newFakeTabletDialer()
+	dialer.prepared["a/0"] = true
+	dialer.prepared["a/1"] = true
+	dialer.failOnce["a/1"] = true // CommitPrepared on a/1 fails this round
+	tr := NewTransactionResolver(store, dialer, 0)
+
+	if err := store.CreateTransaction("dtid1", []string{"a/0", "a/1"}); err != nil {
+		t.Fatalf("CreateTransaction: %v", err)
+	}
+	if err := store.UpdateState("dtid1", TxCommitting); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+
+	txn, err := store.ReadTransaction("dtid1")
+	if err != nil {
+		t.Fatalf("ReadTransaction: %v", err)
+	}
+	tr.resolveOne(txn)
+
+	if _, err := store.ReadTransaction("dtid1"); err != nil {
+		t.Fatalf("ReadTransaction after a failed resolve round: %v, want the record kept for the next tick", err)
+	}
+}
@@ -14,7 +14,9 @@ import (
 	mproto "github.com/youtube/vitess/go/mysql/proto"
 	"github.com/youtube/vitess/go/pools"
 	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/vt/key"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/vtgate/planbuilder"
 	"github.com/youtube/vitess/go/vt/vtgate/proto"
 )
 
@@ -28,9 +30,17 @@ type VTGate struct {
 	connections    *pools.Numbered
 	retryDelay     time.Duration
 	retryCount     int
+	resolver       *Resolver
+	topoServer     TopologyServer
+	planCache      *planbuilder.Cache
+	// sessionTimeout is how long a session may sit idle in connections
+	// before the reaper rolls back its transaction and unregisters it.
+	// Zero disables reaping.
+	sessionTimeout time.Duration
+	txResolver     *TransactionResolver
 }
 
-func Init(blm *BalancerMap, tabletProtocol string, retryDelay time.Duration, retryCount int) {
+func Init(blm *BalancerMap, topoServer TopologyServer, tabletProtocol string, retryDelay time.Duration, retryCount int, sessionTimeout time.Duration, metadataStore MetadataStore, tabletDialer TabletDialer, txResolverPollInterval time.Duration) {
 	if RpcVTGate != nil {
 		log.Fatalf("VTGate already initialized")
 	}
@@ -40,7 +50,14 @@ func Init(blm *BalancerMap, tabletProtocol string, retryDelay time.Duration, ret
 		connections:    pools.NewNumbered(),
 		retryDelay:     retryDelay,
 		retryCount:     retryCount,
+		resolver:       NewResolver(topoServer),
+		topoServer:     topoServer,
+		planCache:      planbuilder.NewCache(),
+		sessionTimeout: sessionTimeout,
+		txResolver:     NewTransactionResolver(metadataStore, tabletDialer, txResolverPollInterval),
 	}
+	RpcVTGate.startReaper()
+	go RpcVTGate.txResolver.Run()
 	proto.RegisterAuthenticated(RpcVTGate)
 }
 
@@ -50,6 +67,7 @@ func (vtg *VTGate) GetSessionId(sessionParams *proto.SessionParams, session *pro
 	scatterConn := NewScatterConn(vtg.balancerMap, vtg.tabletProtocol, sessionParams.TabletType, vtg.retryDelay, vtg.retryCount)
 	session.SessionId = scatterConn.Id
 	vtg.connections.Register(scatterConn.Id, scatterConn)
+	vtgateActiveSessions.Add(1)
 	return nil
 }
 
@@ -91,6 +109,254 @@ func (vtg *VTGate) StreamExecuteShard(context *rpcproto.Context, query *proto.Qu
 	return scatterConn.(*ScatterConn).StreamExecute(query.Sql, query.BindVariables, query.Keyspace, query.Shards, sendReply)
 }
 
+// ExecuteKeyspaceIds executes a non-streaming query based on the
+// specified keyspace ids. It resolves the keyspace ids to shards using
+// the current sharding scheme, then dispatches through ScatterConn the
+// same way ExecuteShard does.
+func (vtg *VTGate) ExecuteKeyspaceIds(context *rpcproto.Context, query *proto.KeyspaceIdQuery, reply *mproto.QueryResult) error {
+	scatterConn, err := vtg.connections.Get(query.SessionId)
+	if err != nil {
+		return fmt.Errorf("query: %s, session %d: %v", query.Sql, query.SessionId, err)
+	}
+	defer vtg.connections.Put(query.SessionId)
+	shards, err := vtg.resolver.ShardsForKeyspaceIds(query.Keyspace, query.KeyspaceIds)
+	if err != nil {
+		return fmt.Errorf("query: %s, keyspace %s: %v", query.Sql, query.Keyspace, err)
+	}
+	qr, err := scatterConn.(*ScatterConn).Execute(query.Sql, query.BindVariables, query.Keyspace, shards)
+	if err == nil {
+		*reply = *qr
+	}
+	return err
+}
+
+// ExecuteKeyRanges executes a non-streaming query on the shards that own
+// the specified key ranges.
+func (vtg *VTGate) ExecuteKeyRanges(context *rpcproto.Context, query *proto.KeyRangeQuery, reply *mproto.QueryResult) error {
+	scatterConn, err := vtg.connections.Get(query.SessionId)
+	if err != nil {
+		return fmt.Errorf("query: %s, session %d: %v", query.Sql, query.SessionId, err)
+	}
+	defer vtg.connections.Put(query.SessionId)
+	shards, err := vtg.resolver.ShardsForKeyRanges(query.Keyspace, query.KeyRanges)
+	if err != nil {
+		return fmt.Errorf("query: %s, keyspace %s: %v", query.Sql, query.Keyspace, err)
+	}
+	qr, err := scatterConn.(*ScatterConn).Execute(query.Sql, query.BindVariables, query.Keyspace, shards)
+	if err == nil {
+		*reply = *qr
+	}
+	return err
+}
+
+// ExecuteBatchKeyspaceIds executes a group of queries on the shards that
+// own the specified keyspace ids.
+func (vtg *VTGate) ExecuteBatchKeyspaceIds(context *rpcproto.Context, batchQuery *proto.BatchKeyspaceIdQuery, reply *tproto.QueryResultList) error {
+	scatterConn, err := vtg.connections.Get(batchQuery.SessionId)
+	if err != nil {
+		return fmt.Errorf("query: %v, session %d: %v", batchQuery.Queries, batchQuery.SessionId, err)
+	}
+	defer vtg.connections.Put(batchQuery.SessionId)
+	shards, err := vtg.resolver.ShardsForKeyspaceIds(batchQuery.Keyspace, batchQuery.KeyspaceIds)
+	if err != nil {
+		return fmt.Errorf("query: %v, keyspace %s: %v", batchQuery.Queries, batchQuery.Keyspace, err)
+	}
+	qrs, err := scatterConn.(*ScatterConn).ExecuteBatch(batchQuery.Queries, batchQuery.Keyspace, shards)
+	if err == nil {
+		*reply = *qrs
+	}
+	return err
+}
+
+// StreamExecuteKeyspaceIds executes a streaming query on the shards that
+// own the specified keyspace ids.
+func (vtg *VTGate) StreamExecuteKeyspaceIds(context *rpcproto.Context, query *proto.KeyspaceIdQuery, sendReply func(interface{}) error) error {
+	scatterConn, err := vtg.connections.Get(query.SessionId)
+	if err != nil {
+		return fmt.Errorf("query: %s, session %d: %v", query.Sql, query.SessionId, err)
+	}
+	defer vtg.connections.Put(query.SessionId)
+	shards, err := vtg.resolver.ShardsForKeyspaceIds(query.Keyspace, query.KeyspaceIds)
+	if err != nil {
+		return fmt.Errorf("query: %s, keyspace %s: %v", query.Sql, query.Keyspace, err)
+	}
+	return scatterConn.(*ScatterConn).StreamExecute(query.Sql, query.BindVariables, query.Keyspace, shards, sendReply)
+}
+
+// Execute executes a non-streaming query given as plain SQL, with no
+// shard list or keyspace ids: VTGate parses out the sharding key
+// predicate itself, via routeShards, and dispatches through ScatterConn
+// the same way ExecuteShard does.
+func (vtg *VTGate) Execute(context *rpcproto.Context, query *proto.Query, reply *mproto.QueryResult) error {
+	scatterConn, err := vtg.connections.Get(query.SessionId)
+	if err != nil {
+		return fmt.Errorf("query: %s, session %d: %v", query.Sql, query.SessionId, err)
+	}
+	defer vtg.connections.Put(query.SessionId)
+	shards, err := vtg.routeShards(query.Sql, query.Keyspace, query.BindVariables, query.AllowScatter)
+	if err != nil {
+		return fmt.Errorf("query: %s, keyspace %s: %v", query.Sql, query.Keyspace, err)
+	}
+	qr, err := scatterConn.(*ScatterConn).Execute(query.Sql, query.BindVariables, query.Keyspace, shards)
+	if err == nil {
+		*reply = *qr
+	}
+	return err
+}
+
+// StreamExecute executes a streaming query given as plain SQL, routed
+// the same way Execute routes a non-streaming one.
+func (vtg *VTGate) StreamExecute(context *rpcproto.Context, query *proto.Query, sendReply func(interface{}) error) error {
+	scatterConn, err := vtg.connections.Get(query.SessionId)
+	if err != nil {
+		return fmt.Errorf("query: %s, session %d: %v", query.Sql, query.SessionId, err)
+	}
+	defer vtg.connections.Put(query.SessionId)
+	shards, err := vtg.routeShards(query.Sql, query.Keyspace, query.BindVariables, query.AllowScatter)
+	if err != nil {
+		return fmt.Errorf("query: %s, keyspace %s: %v", query.Sql, query.Keyspace, err)
+	}
+	return scatterConn.(*ScatterConn).StreamExecute(query.Sql, query.BindVariables, query.Keyspace, shards, sendReply)
+}
+
+// ExecuteBatch executes a group of queries given as plain SQL. Each
+// query is routed independently; the batch as a whole is sent to the
+// union of the shards any of them need.
+func (vtg *VTGate) ExecuteBatch(context *rpcproto.Context, batchQuery *proto.BatchQuery, reply *tproto.QueryResultList) error {
+	scatterConn, err := vtg.connections.Get(batchQuery.SessionId)
+	if err != nil {
+		return fmt.Errorf("query: %v, session %d: %v", batchQuery.Queries, batchQuery.SessionId, err)
+	}
+	defer vtg.connections.Put(batchQuery.SessionId)
+	shards, err := vtg.routeShardsForBatch(batchQuery.Queries, batchQuery.Keyspace, batchQuery.AllowScatter)
+	if err != nil {
+		return fmt.Errorf("query: %v, keyspace %s: %v", batchQuery.Queries, batchQuery.Keyspace, err)
+	}
+	qrs, err := scatterConn.(*ScatterConn).ExecuteBatch(batchQuery.Queries, batchQuery.Keyspace, shards)
+	if err == nil {
+		*reply = *qrs
+	}
+	return err
+}
+
+// routeShards plans sql against keyspace's sharding column and resolves
+// it to a concrete shard list, the way ExecuteKeyspaceIds and
+// ExecuteKeyRanges do for callers who already know their keyspace ids or
+// key ranges, but without requiring the caller to compute either one.
+func (vtg *VTGate) routeShards(sql, keyspace string, bindVariables map[string]interface{}, allowScatter bool) ([]string, error) {
+	shardingColumn, err := vtg.topoServer.ShardingColumnForKeyspace(keyspace)
+	if err != nil {
+		return nil, err
+	}
+	normalized, extracted := planbuilder.Normalize(sql)
+	// The Route depends on shardingColumn, which varies by keyspace, so
+	// the cache must be keyed on both: normalized SQL alone would let
+	// two keyspaces sharded on different columns collide on the same
+	// statement shape and mis-route one of them onto the other's Route.
+	cacheKey := keyspace + "\x00" + normalized
+	route, ok := vtg.planCache.Get(cacheKey)
+	if !ok {
+		route, err = planbuilder.BuildRoute(normalized, shardingColumn, allowScatter)
+		if err != nil {
+			return nil, err
+		}
+		vtg.planCache.Set(cacheKey, route)
+	}
+
+	values := bindVariables
+	if len(extracted) > 0 {
+		values = make(map[string]interface{}, len(bindVariables)+len(extracted))
+		for k, v := range bindVariables {
+			values[k] = v
+		}
+		for k, v := range extracted {
+			values[k] = v
+		}
+	}
+
+	switch route.Opcode {
+	case planbuilder.SelectScatter:
+		// The cached Route only records that this statement has no
+		// usable sharding key predicate, not whether scatter is allowed:
+		// that is a per-session flag, and it must be re-checked on every
+		// call or a session with AllowScatter=false could get a cache
+		// hit off an earlier session's AllowScatter=true decision.
+		if !allowScatter {
+			return nil, planbuilder.ErrScatterNotAllowed
+		}
+		return vtg.resolver.AllShards(keyspace)
+	case planbuilder.SelectEqual:
+		id, err := vtg.topoServer.KeyspaceIdForValue(keyspace, values[route.BindVar])
+		if err != nil {
+			return nil, err
+		}
+		return vtg.resolver.ShardsForKeyspaceIds(keyspace, []key.KeyspaceId{id})
+	case planbuilder.SelectIN:
+		ids := make([]key.KeyspaceId, 0, len(route.BindVars))
+		for _, bv := range route.BindVars {
+			id, err := vtg.topoServer.KeyspaceIdForValue(keyspace, values[bv])
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return vtg.resolver.ShardsForKeyspaceIds(keyspace, ids)
+	case planbuilder.SelectRange:
+		// A range of sharding column values only maps to a single
+		// KeyRange when keyspace ids preserve that column's ordering.
+		// For a hash-sharded keyspace the endpoints' hashes are
+		// unordered, so [hash(from), hash(to)) would route to the wrong
+		// shards and silently drop rows; scatter instead.
+		scheme, err := vtg.topoServer.ShardingSchemeForKeyspace(keyspace)
+		if err != nil {
+			return nil, err
+		}
+		if scheme != RangeSharded {
+			if !allowScatter {
+				return nil, fmt.Errorf("planbuilder: range query on hash-sharded keyspace %s cannot be resolved to a keyrange and scatter is disabled for this session", keyspace)
+			}
+			return vtg.resolver.AllShards(keyspace)
+		}
+		var kr key.KeyRange
+		if route.FromBindVar != "" {
+			id, err := vtg.topoServer.KeyspaceIdForValue(keyspace, values[route.FromBindVar])
+			if err != nil {
+				return nil, err
+			}
+			kr.Start = id
+		}
+		if route.ToBindVar != "" {
+			id, err := vtg.topoServer.KeyspaceIdForValue(keyspace, values[route.ToBindVar])
+			if err != nil {
+				return nil, err
+			}
+			kr.End = id
+		}
+		return vtg.resolver.ShardsForKeyRanges(keyspace, []key.KeyRange{kr})
+	}
+	return nil, fmt.Errorf("planbuilder: unknown route opcode %v", route.Opcode)
+}
+
+// routeShardsForBatch routes every query in queries and returns the
+// union of the shards any of them resolved to.
+func (vtg *VTGate) routeShardsForBatch(queries []tproto.BoundQuery, keyspace string, allowScatter bool) ([]string, error) {
+	seen := make(map[string]bool)
+	var shards []string
+	for _, q := range queries {
+		qShards, err := vtg.routeShards(q.Sql, keyspace, q.BindVariables, allowScatter)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range qShards {
+			if !seen[shard] {
+				seen[shard] = true
+				shards = append(shards, shard)
+			}
+		}
+	}
+	return shards, nil
+}
+
 // Begin begins a transaction. It has to be concluded by a Commit or Rollback.
 func (vtg *VTGate) Begin(context *rpcproto.Context, session *proto.Session, noOutput *string) error {
 	scatterConn, err := vtg.connections.Get(session.SessionId)
@@ -101,13 +367,33 @@ func (vtg *VTGate) Begin(context *rpcproto.Context, session *proto.Session, noOu
 	return scatterConn.(*ScatterConn).Begin()
 }
 
-// Commit commits a transaction.
+// Begin2PC begins a transaction that must be committed atomically across
+// every shard it touches: its eventual Commit goes through two-phase
+// commit instead of the shard-by-shard ScatterConn.Commit, so a mid-flight
+// failure never leaves it partially committed.
+func (vtg *VTGate) Begin2PC(context *rpcproto.Context, session *proto.Session, noOutput *string) error {
+	scatterConn, err := vtg.connections.Get(session.SessionId)
+	if err != nil {
+		return fmt.Errorf("session %d: %v", session.SessionId, err)
+	}
+	defer vtg.connections.Put(session.SessionId)
+	vtg.txResolver.MarkAtomic(session.SessionId)
+	return scatterConn.(*ScatterConn).Begin()
+}
+
+// Commit commits a transaction. If it was started with Begin2PC, it is
+// driven through two-phase commit; otherwise ScatterConn commits it
+// shard-by-shard as before.
 func (vtg *VTGate) Commit(context *rpcproto.Context, session *proto.Session, noOutput *string) error {
 	scatterConn, err := vtg.connections.Get(session.SessionId)
 	if err != nil {
 		return fmt.Errorf("session %d: %v", session.SessionId, err)
 	}
 	defer vtg.connections.Put(session.SessionId)
+	defer vtg.txResolver.Forget(session.SessionId)
+	if vtg.txResolver.IsAtomic(session.SessionId) {
+		return vtg.txResolver.Commit(scatterConn.(*ScatterConn))
+	}
 	return scatterConn.(*ScatterConn).Commit()
 }
 
@@ -118,6 +404,7 @@ func (vtg *VTGate) Rollback(context *rpcproto.Context, session *proto.Session, n
 		return fmt.Errorf("session %d: %v", session.SessionId, err)
 	}
 	defer vtg.connections.Put(session.SessionId)
+	defer vtg.txResolver.Forget(session.SessionId)
 	return scatterConn.(*ScatterConn).Rollback()
 }
 
@@ -128,6 +415,8 @@ func (vtg *VTGate) CloseSession(context *rpcproto.Context, session *proto.Sessio
 		return nil
 	}
 	defer vtg.connections.Unregister(session.SessionId)
+	vtg.txResolver.Forget(session.SessionId)
 	scatterConn.(*ScatterConn).Close()
+	vtgateActiveSessions.Add(-1)
 	return nil
 }
@@ -0,0 +1,74 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/vtgate/planbuilder"
+)
+
+// fakeTopologyServer is a single-keyspace, single-shard TopologyServer
+// for exercising routeShards without a real topology.
+type fakeTopologyServer struct {
+	shardingColumn string
+	scheme         ShardingScheme
+}
+
+func (f *fakeTopologyServer) GetShardsForKeyspace(keyspace string) ([]ShardSpec, error) {
+	return []ShardSpec{{Shard: "0", KeyRange: key.KeyRange{}}}, nil
+}
+
+func (f *fakeTopologyServer) ShardingColumnForKeyspace(keyspace string) (string, error) {
+	return f.shardingColumn, nil
+}
+
+func (f *fakeTopologyServer) ShardingSchemeForKeyspace(keyspace string) (ShardingScheme, error) {
+	return f.scheme, nil
+}
+
+func (f *fakeTopologyServer) KeyspaceIdForValue(keyspace string, value interface{}) (key.KeyspaceId, error) {
+	return key.KeyspaceId("x"), nil
+}
+
+func newTestVTGate(topoServer TopologyServer) *VTGate {
+	return &VTGate{
+		topoServer: topoServer,
+		resolver:   NewResolver(topoServer),
+		planCache:  planbuilder.NewCache(),
+	}
+}
+
+func TestRouteShardsScatterRechecksAllowScatterOnCacheHit(t *testing.T) {
+	vtg := newTestVTGate(&fakeTopologyServer{shardingColumn: "user_id", scheme: RangeSharded})
+	sql := "select * from user where name = 'bob'"
+
+	if _, err := vtg.routeShards(sql, "ks", nil, true); err != nil {
+		t.Fatalf("routeShards with AllowScatter=true: %v", err)
+	}
+	// Same keyspace and normalized SQL, so this hits the cached
+	// SelectScatter Route built for the first, AllowScatter=true call.
+	if _, err := vtg.routeShards(sql, "ks", nil, false); err != planbuilder.ErrScatterNotAllowed {
+		t.Fatalf("routeShards with AllowScatter=false on a cache hit: err = %v, want ErrScatterNotAllowed", err)
+	}
+}
+
+func TestRouteShardsRangeOnHashShardedKeyspaceScattersInsteadOfMisrouting(t *testing.T) {
+	vtg := newTestVTGate(&fakeTopologyServer{shardingColumn: "user_id", scheme: HashSharded})
+	sql := "select * from user where user_id >= 10 and user_id < 20"
+
+	shards, err := vtg.routeShards(sql, "ks", nil, true)
+	if err != nil {
+		t.Fatalf("routeShards: %v", err)
+	}
+	if len(shards) != 1 || shards[0] != "0" {
+		t.Fatalf("shards = %v, want the scattered shard list [0]", shards)
+	}
+
+	if _, err := vtg.routeShards(sql, "ks", nil, false); err == nil {
+		t.Fatalf("routeShards with AllowScatter=false on a hash-sharded range: want an error, got none")
+	}
+}